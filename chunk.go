@@ -0,0 +1,134 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// discordMessageLimit is Discord's hard cap on a single message's content.
+const discordMessageLimit = 2000
+
+// chunkSize is the target length for each chunk splitMessage produces,
+// leaving headroom below discordMessageLimit for a re-opened "```" fence.
+const chunkSize = 1950
+
+// splitMessage splits content into pieces of at most chunkSize bytes (before
+// any fence lines are added), breaking on a paragraph, then line, then word
+// boundary. If a break falls inside an
+// open ``` code fence, the fence is closed at the end of the chunk and
+// re-opened (with the same language tag, if any) at the start of the next.
+func splitMessage(content string) []string {
+	if len(content) <= chunkSize {
+		return []string{content}
+	}
+
+	var chunks []string
+	inFence := false
+	fenceLang := ""
+
+	for len(content) > 0 {
+		if len(content) <= chunkSize {
+			chunks = append(chunks, reopenFence(inFence, fenceLang, content))
+			break
+		}
+
+		cut := lastBoundary(content, chunkSize)
+		chunk := content[:cut]
+		content = strings.TrimLeft(content[cut:], "\n")
+
+		endsInFence, lang := fenceState(chunk, inFence, fenceLang)
+		chunkBody := reopenFence(inFence, fenceLang, chunk)
+		if endsInFence {
+			chunkBody += "\n```"
+		}
+		chunks = append(chunks, chunkBody)
+
+		inFence, fenceLang = endsInFence, lang
+	}
+
+	return chunks
+}
+
+func reopenFence(open bool, lang string, chunk string) string {
+	if !open {
+		return chunk
+	}
+	return "```" + lang + "\n" + chunk
+}
+
+// fenceState scans chunk for ``` fences, starting inside a fence opened with
+// openLang if open is true, and reports whether the chunk ends inside a fence
+// and, if so, what language it was opened with ("" for an untagged fence).
+func fenceState(chunk string, open bool, openLang string) (bool, string) {
+	inFence := open
+	lang := openLang
+	for _, line := range strings.Split(chunk, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, "```") {
+			continue
+		}
+		if inFence {
+			inFence = false
+			lang = ""
+		} else {
+			inFence = true
+			lang = strings.TrimSpace(strings.TrimPrefix(trimmed, "```"))
+		}
+	}
+	return inFence, lang
+}
+
+// sendChunked sends params through a Discord webhook, splitting params.Content
+// into multiple messages if it exceeds chunkSize. Only the first
+// chunk carries params' files; later chunks are plain text continuations.
+// Every send goes through limiter, keyed by channelID, so a 429 backs off
+// and retries rather than dropping the chunk.
+func sendChunked(dg *discordgo.Session, limiter *RateLimiter, channelID string, webhookID string, webhookToken string, params *discordgo.WebhookParams) (*discordgo.Message, error) {
+	chunks := splitMessage(params.Content)
+
+	var first *discordgo.Message
+	for i, chunk := range chunks {
+		chunkParams := *params
+		chunkParams.Content = chunk
+		if i > 0 {
+			chunkParams.Files = nil
+		}
+
+		var msg *discordgo.Message
+		err := limiter.Do(channelID, func() error {
+			var sendErr error
+			msg, sendErr = dg.WebhookExecute(webhookID, webhookToken, true, &chunkParams)
+			return sendErr
+		})
+		if err != nil {
+			return first, err
+		}
+		if i == 0 {
+			first = msg
+		}
+	}
+
+	return first, nil
+}
+
+// lastBoundary returns the index of the last paragraph, line, or word
+// boundary at or before limit, falling back to the nearest earlier rune
+// boundary if content has none of those.
+func lastBoundary(content string, limit int) int {
+	window := content[:limit]
+	if idx := strings.LastIndex(window, "\n\n"); idx > 0 {
+		return idx + 2
+	}
+	if idx := strings.LastIndex(window, "\n"); idx > 0 {
+		return idx + 1
+	}
+	if idx := strings.LastIndex(window, " "); idx > 0 {
+		return idx + 1
+	}
+	for limit > 0 && !utf8.RuneStart(content[limit]) {
+		limit--
+	}
+	return limit
+}
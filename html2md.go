@@ -0,0 +1,80 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	mxReplyRe    = regexp.MustCompile(`(?is)<mx-reply>.*?</mx-reply>`)
+	codeBlockRe  = regexp.MustCompile(`(?is)<pre><code(?:\s+class="language-([a-zA-Z0-9_+-]*)")?>(.*?)</code></pre>`)
+	inlineCodeRe = regexp.MustCompile(`(?is)<code>(.*?)</code>`)
+	strongRe     = regexp.MustCompile(`(?is)<(?:strong|b)>(.*?)</(?:strong|b)>`)
+	emRe         = regexp.MustCompile(`(?is)<(?:em|i)>(.*?)</(?:em|i)>`)
+	blockquoteRe = regexp.MustCompile(`(?is)<blockquote>(.*?)</blockquote>`)
+	imgRe        = regexp.MustCompile(`(?is)<img[^>]*\bsrc="([^"]*)"[^>]*/?>`)
+	matrixToRe   = regexp.MustCompile(`(?is)<a[^>]*\bhref="https://matrix\.to/#/(@[^"]+)"[^>]*>(.*?)</a>`)
+	linkRe       = regexp.MustCompile(`(?is)<a[^>]*\bhref="([^"]*)"[^>]*>(.*?)</a>`)
+	brRe         = regexp.MustCompile(`(?is)<br\s*/?>`)
+	paragraphRe  = regexp.MustCompile(`(?is)</p>\s*<p>`)
+	tagRe        = regexp.MustCompile(`(?is)<[^>]+>`)
+)
+
+// matrixHTMLToDiscord converts a Matrix formatted_body (org.matrix.custom.html)
+// into Discord-flavored Markdown.
+func matrixHTMLToDiscord(config *Config, formattedBody string) string {
+	body := formattedBody
+	if !config.KeepQuotedReply {
+		body = mxReplyRe.ReplaceAllString(body, "")
+	}
+
+	body = codeBlockRe.ReplaceAllStringFunc(body, func(match string) string {
+		groups := codeBlockRe.FindStringSubmatch(match)
+		return "```" + groups[1] + "\n" + html.UnescapeString(groups[2]) + "\n```"
+	})
+	body = inlineCodeRe.ReplaceAllString(body, "`$1`")
+	body = strongRe.ReplaceAllString(body, "**$1**")
+	body = emRe.ReplaceAllString(body, "*$1*")
+
+	body = blockquoteRe.ReplaceAllStringFunc(body, func(match string) string {
+		groups := blockquoteRe.FindStringSubmatch(match)
+		lines := strings.Split(strings.TrimSpace(groups[1]), "\n")
+		for i, line := range lines {
+			lines[i] = "> " + strings.TrimSpace(line)
+		}
+		return strings.Join(lines, "\n")
+	})
+
+	body = imgRe.ReplaceAllStringFunc(body, func(match string) string {
+		groups := imgRe.FindStringSubmatch(match)
+		return resolveMatrixMediaURL(config, groups[1])
+	})
+
+	// Matrix pings (<a href="https://matrix.to/#/@user:server">name</a>) resolve
+	// to a Discord mention when the pinged Matrix user has an entry in
+	// config.UserMap; otherwise they degrade to their plain display text.
+	body = matrixToRe.ReplaceAllStringFunc(body, func(match string) string {
+		groups := matrixToRe.FindStringSubmatch(match)
+		if discordID, ok := config.UserMap[groups[1]]; ok {
+			return "<@" + discordID + ">"
+		}
+		return groups[2]
+	})
+	body = linkRe.ReplaceAllString(body, "[$2]($1)")
+
+	body = brRe.ReplaceAllString(body, "\n")
+	body = paragraphRe.ReplaceAllString(body, "\n\n")
+	body = tagRe.ReplaceAllString(body, "")
+
+	return html.UnescapeString(strings.TrimSpace(body))
+}
+
+// resolveMatrixMediaURL turns a mxc:// URL into an HTTP(S) download URL on
+// the configured homeserver; URLs that aren't mxc:// already pass through.
+func resolveMatrixMediaURL(config *Config, uri string) string {
+	if strings.HasPrefix(uri, "mxc://") {
+		return config.Matrix.Homeserver + "/_matrix/media/r0/download/" + uri[len("mxc://"):]
+	}
+	return uri
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -9,7 +10,9 @@ import (
 	"log"
 	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -37,6 +40,23 @@ type Config struct {
 
 	// A map from discord channel ID to matrix room ID
 	Bridge map[string]string `json:"bridge"`
+
+	// Whether to keep Element's quoted-reply fallback ("> <@user> ..." lines)
+	// in the body sent to Discord instead of stripping it.
+	KeepQuotedReply bool `json:"keep_quoted_reply"`
+
+	// How long a cached Matrix display name/avatar is used before being
+	// refreshed from the homeserver. Defaults to 1 hour if zero.
+	NicknameCacheTTLSeconds int `json:"nickname_cache_ttl_seconds"`
+
+	// Maps a Matrix user ID to the Discord user ID it should be rendered as
+	// an @-mention for, when resolving matrix.to pings in formatted_body.
+	UserMap map[string]string `json:"user_map"`
+
+	// Whether to shell out to ffprobe to populate info.duration (and, for
+	// video, info.w/info.h) on re-uploaded audio/video attachments. Off by
+	// default since it requires ffprobe to be installed.
+	ProbeMediaDuration bool `json:"probe_media_duration"`
 }
 
 func writeDefaultConfig(configPath string) {
@@ -76,20 +96,85 @@ func stripMatrixName(username string) string {
 	return username
 }
 
-func getContent(config *Config, uri string) (io.Reader, error) {
+// stripQuotedReply removes Element's quoted-reply fallback block ("> <@user:server> ..."
+// lines plus the blank line after them) from the start of body.
+func stripQuotedReply(body string) string {
+	lines := strings.Split(body, "\n")
+	i := 0
+	for i < len(lines) && strings.HasPrefix(lines[i], "> ") {
+		i++
+	}
+	for i < len(lines) && strings.TrimSpace(lines[i]) == "" {
+		i++
+	}
+	return strings.Join(lines[i:], "\n")
+}
+
+// teeCloser pairs a reader (possibly composed of already-peeked bytes plus
+// the remainder of a response body) with the underlying closer that must
+// still be closed once the caller is done reading.
+type teeCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (t teeCloser) Close() error { return t.closer.Close() }
+
+// getContent fetches uri (resolving mxc:// URIs against the homeserver) and
+// returns a streaming reader, the content length (-1 if unknown), and the
+// MIME type. If the source doesn't report a MIME type, or reports the
+// generic application/octet-stream, the first 512 bytes are sniffed with
+// http.DetectContentType and transparently stitched back onto the stream.
+func getContent(config *Config, uri string) (io.ReadCloser, int64, string, error) {
+	url := uri
 	if strings.HasPrefix(uri, "mxc://") {
-		resp, err := http.Get(config.Matrix.Homeserver + "/_matrix/media/r0/download/" + uri[6:])
-		if err != nil {
-			return nil, err
-		}
-		return resp.Body, nil
-	} else {
-		resp, err := http.Get(uri)
-		if err != nil {
-			return nil, err
-		}
-		return resp.Body, nil
+		url = config.Matrix.Homeserver + "/_matrix/media/r0/download/" + uri[6:]
+	}
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	mimeType := resp.Header.Get("Content-Type")
+	if mimeType != "" && mimeType != "application/octet-stream" {
+		return resp.Body, resp.ContentLength, mimeType, nil
+	}
+
+	peek := make([]byte, 512)
+	n, err := io.ReadFull(resp.Body, peek)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		resp.Body.Close()
+		return nil, 0, "", err
+	}
+	peek = peek[:n]
+
+	body := teeCloser{Reader: io.MultiReader(bytes.NewReader(peek), resp.Body), closer: resp.Body}
+	return body, resp.ContentLength, http.DetectContentType(peek), nil
+}
+
+// redactMatrixEvent sends a Matrix redaction for eventID in roomID.
+func redactMatrixEvent(config *Config, roomID string, eventID string) error {
+	txnID := strconv.FormatInt(time.Now().UnixNano(), 10)
+	uri := config.Matrix.Homeserver + "/_matrix/client/r0/rooms/" + url.PathEscape(roomID) + "/redact/" + url.PathEscape(eventID) + "/" + txnID
+
+	req, err := http.NewRequest("PUT", uri, strings.NewReader("{}"))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+config.Matrix.AccessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("matrix redaction failed with status %d", resp.StatusCode)
 	}
+	return nil
 }
 
 func fileSize(bytes int) string {
@@ -118,12 +203,63 @@ func discordMsgToMatrixHTML(sender string, content string) string {
 	return "<b>" + sender + "</b>: " + contentHTML
 }
 
-func matrixMsgToDiscord(sender string, content map[string]interface{}) string {
+// discordReplyRelation builds the Matrix m.relates_to/m.in_reply_to relation
+// and an <mx-reply> fallback prefix for a Discord reply, or (nil, "") if m
+// doesn't reply to another bridged message.
+func discordReplyRelation(messageManager *MessageManager, roomID string, m *discordgo.Message) (map[string]interface{}, string) {
+	if m.MessageReference == nil {
+		return nil, ""
+	}
+	replyInfo := messageManager.GetDiscord(m.MessageReference.MessageID)
+	if replyInfo == nil {
+		return nil, ""
+	}
+
+	relatesTo := map[string]interface{}{
+		"m.in_reply_to": map[string]interface{}{
+			"event_id": replyInfo.MatrixID,
+		},
+	}
+
+	quotedAuthor := "message"
+	quotedBody := ""
+	if m.ReferencedMessage != nil {
+		quotedAuthor = m.ReferencedMessage.Author.Username
+		quotedBody = m.ReferencedMessage.Content
+	}
+	replyFallback := fmt.Sprintf(
+		"<mx-reply><blockquote><a href=\"https://matrix.to/#/%s/%s\">In reply to</a> <a href=\"https://matrix.to/#/%s\">%s</a><br>%s</blockquote></mx-reply>",
+		roomID, replyInfo.MatrixID, m.Author.ID, html.EscapeString(quotedAuthor), html.EscapeString(quotedBody))
+
+	return relatesTo, replyFallback
+}
+
+// formatReplyQuote builds a one-line Discord blockquote summarizing the
+// message being replied to. Webhook-posted messages can't carry a native
+// message_reference, so this is folded into the body instead.
+func formatReplyQuote(author string, content string) string {
+	if content == "" {
+		return ""
+	}
+	quoted := strings.SplitN(content, "\n", 2)[0]
+	if runes := []rune(quoted); len(runes) > 100 {
+		quoted = string(runes[:100]) + "…"
+	}
+	return "> **" + author + "**: " + quoted + "\n"
+}
+
+func matrixMsgToDiscord(config *Config, sender string, content map[string]interface{}) string {
+	body := fmt.Sprint(content["body"])
+	if content["format"] == "org.matrix.custom.html" {
+		if formattedBody, ok := content["formatted_body"].(string); ok {
+			body = matrixHTMLToDiscord(config, formattedBody)
+		}
+	}
+
 	if content["msgtype"] == "m.emote" {
-		return "* **" + stripMatrixName(sender) + "** " + fmt.Sprint(content["body"])
-	} else {
-		return fmt.Sprint(content["body"])
+		return "* **" + stripMatrixName(sender) + "** " + body
 	}
+	return body
 }
 
 func main() {
@@ -177,8 +313,38 @@ func main() {
 		panic("error creating message manager: " + err.Error())
 	}
 
+	nicknameCacheTTL := time.Duration(config.NicknameCacheTTLSeconds) * time.Second
+	nicknames := NewNicknameCache(&config, nicknameCacheTTL)
+
+	limiter := NewRateLimiter()
+
+	uploadSizeLimit := fetchMatrixUploadLimit(&config)
+
 	// handle events
 	syncer := mg.Syncer.(*gomatrix.DefaultSyncer)
+	syncer.OnEventType("m.room.member", func(ev *gomatrix.Event) {
+		nicknames.Invalidate(ev.Sender)
+	})
+	syncer.OnEventType("m.room.redaction", func(ev *gomatrix.Event) {
+		if ev.Sender == config.Matrix.Username {
+			return
+		}
+
+		messageInfo := messageManager.GetMatrix(ev.Redacts)
+		if messageInfo == nil {
+			return
+		}
+
+		err := limiter.Do(messageInfo.ChannelID, func() error {
+			if messageInfo.WebhookID != "" {
+				return dg.WebhookMessageDelete(messageInfo.WebhookID, messageInfo.WebhookToken, messageInfo.DiscordID)
+			}
+			return dg.ChannelMessageDelete(messageInfo.ChannelID, messageInfo.DiscordID)
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error deleting discord message: ", err)
+		}
+	})
 	syncer.OnEventType("m.room.message", func(ev *gomatrix.Event) {
 		if ev.Timestamp < startTime {
 			return
@@ -206,8 +372,11 @@ func main() {
 				return
 			}
 
-			content := matrixMsgToDiscord(ev.Sender, newContent)
-			_, err = dg.WebhookMessageEdit(messageInfo.WebhookID, messageInfo.WebhookToken, messageInfo.DiscordID, &discordgo.WebhookEdit{Content: &content})
+			content := matrixMsgToDiscord(&config, ev.Sender, newContent)
+			err = limiter.Do(discordChannelID, func() error {
+				_, editErr := dg.WebhookMessageEdit(messageInfo.WebhookID, messageInfo.WebhookToken, messageInfo.DiscordID, &discordgo.WebhookEdit{Content: &content})
+				return editErr
+			})
 			if err != nil {
 				log.Println("error editing discord message:", err)
 			}
@@ -217,40 +386,79 @@ func main() {
 				fmt.Fprintln(os.Stderr, "error getting webhook: ", err)
 			}
 
+			// m.in_reply_to is nested inside m.relates_to without a rel_type,
+			// so it falls through here rather than the m.replace branch above.
+			var replyInfo *MessageInfo
+			if ok {
+				if inReplyTo, ok := relatesTo["m.in_reply_to"].(map[string]interface{}); ok {
+					replyInfo = messageManager.GetMatrix(fmt.Sprint(inReplyTo["event_id"]))
+				}
+			}
+			allowedMentions := &discordgo.MessageAllowedMentions{
+				Parse: []discordgo.AllowedMentionType{discordgo.AllowedMentionTypeUsers, discordgo.AllowedMentionTypeRoles},
+			}
+
+			displayName, avatarSource := nicknames.Get(ev.Sender)
+			avatarURL := webhooks.SyncAvatar(&config, discordChannelID, ev.Sender, avatarSource)
+
 			var discordMsg *discordgo.Message
 			switch fmt.Sprint(ev.Content["msgtype"]) {
 			case "m.text", "m.notice", "m.emote":
-				discordMsg, err = dg.WebhookExecute(webhookId, webhookToken, true, &discordgo.WebhookParams{
-					Content:  matrixMsgToDiscord(ev.Sender, ev.Content),
-					Username: stripMatrixName(ev.Sender)})
+				body := matrixMsgToDiscord(&config, ev.Sender, ev.Content)
+				if replyInfo != nil && !config.KeepQuotedReply {
+					body = stripQuotedReply(body)
+				}
+				if replyInfo != nil {
+					body = formatReplyQuote(replyInfo.Author, replyInfo.Content) + body
+				}
+				discordMsg, err = sendChunked(dg, limiter, discordChannelID, webhookId, webhookToken, &discordgo.WebhookParams{
+					Content:         body,
+					Username:        displayName,
+					AvatarURL:       avatarURL,
+					AllowedMentions: allowedMentions})
 				if err != nil {
 					fmt.Fprintln(os.Stderr, "error sending webhook: ", err)
 				}
 			case "m.image", "m.audio", "m.video":
 				mimeType := fmt.Sprint(ev.Content["info"].(map[string]interface{})["mimetype"])
+				reader, _, sniffedMime, err := getContent(&config, fmt.Sprint(ev.Content["url"]))
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "error reading image/audio/video: ", err)
+				} else {
+					defer reader.Close()
+				}
+				if mimeType == "" || mimeType == "application/octet-stream" {
+					mimeType = sniffedMime
+				}
 				extensions, err := mime.ExtensionsByType(mimeType)
 				extension := ""
 				if err == nil && len(extensions) != 0 {
 					extension = extensions[0]
 				}
-				reader, err := getContent(&config, fmt.Sprint(ev.Content["url"]))
-				if err != nil {
-					fmt.Fprintln(os.Stderr, "error reading image/audio/video: ", err)
-				}
-				_, err = dg.WebhookExecute(webhookId, webhookToken, true, &discordgo.WebhookParams{
-					Files: []*discordgo.File{{
-						Name:        fmt.Sprint(ev.Content["msgtype"])[2:] + extension,
-						ContentType: mimeType,
-						Reader:      reader,
-					}},
-					Username: stripMatrixName(ev.Sender)})
+				err = limiter.Do(discordChannelID, func() error {
+					_, sendErr := dg.WebhookExecute(webhookId, webhookToken, true, &discordgo.WebhookParams{
+						Files: []*discordgo.File{{
+							Name:        fmt.Sprint(ev.Content["msgtype"])[2:] + extension,
+							ContentType: mimeType,
+							Reader:      reader,
+						}},
+						Username:  displayName,
+						AvatarURL: avatarURL})
+					return sendErr
+				})
 				if err != nil {
 					fmt.Fprintln(os.Stderr, "error sending webhook: ", err)
 				}
 			case "m.file":
-				reader, err := getContent(&config, fmt.Sprint(ev.Content["url"]))
+				mimeType := fmt.Sprint(ev.Content["info"].(map[string]interface{})["mimetype"])
+				reader, _, sniffedMime, err := getContent(&config, fmt.Sprint(ev.Content["url"]))
 				if err != nil {
 					fmt.Fprintln(os.Stderr, "error reading file: ", err)
+				} else {
+					defer reader.Close()
+				}
+				if mimeType == "" || mimeType == "application/octet-stream" {
+					mimeType = sniffedMime
 				}
 
 				filename := ""
@@ -261,13 +469,17 @@ func main() {
 				}
 
 				if err == nil {
-					_, err = dg.WebhookExecute(webhookId, webhookToken, true, &discordgo.WebhookParams{
-						Files: []*discordgo.File{{
-							Name:        filename,
-							ContentType: fmt.Sprint(ev.Content["info"].(map[string]interface{})["mimetype"]),
-							Reader:      reader,
-						}},
-						Username: stripMatrixName(ev.Sender)})
+					err = limiter.Do(discordChannelID, func() error {
+						_, sendErr := dg.WebhookExecute(webhookId, webhookToken, true, &discordgo.WebhookParams{
+							Files: []*discordgo.File{{
+								Name:        filename,
+								ContentType: mimeType,
+								Reader:      reader,
+							}},
+							Username:  displayName,
+							AvatarURL: avatarURL})
+						return sendErr
+					})
 					if err != nil {
 						fmt.Fprintln(os.Stderr, "error sending webhook: ", err)
 					}
@@ -277,8 +489,9 @@ func main() {
 			if discordMsg != nil {
 				messageManager.Add(&MessageInfo{
 					WebhookID: webhookId, WebhookToken: webhookToken,
-					DiscordID: discordMsg.ID,
-					MatrixID:  ev.ID, RoomID: ev.RoomID,
+					DiscordID: discordMsg.ID, ChannelID: discordChannelID,
+					MatrixID: ev.ID, RoomID: ev.RoomID,
+					Content: fmt.Sprint(ev.Content["body"]), Author: displayName,
 				})
 			}
 		}
@@ -295,60 +508,89 @@ func main() {
 
 		var ev *gomatrix.RespSendEvent
 		if m.Content != "" {
-			ev, err = mg.SendFormattedText(roomID,
-				m.Author.Username+": "+m.Content,
-				discordMsgToMatrixHTML(m.Author.Username, m.Content))
+			content := map[string]interface{}{
+				"body":           m.Author.Username + ": " + m.Content,
+				"msgtype":        "m.text",
+				"format":         "org.matrix.custom.html",
+				"formatted_body": discordMsgToMatrixHTML(m.Author.Username, m.Content),
+			}
+
+			if relatesTo, replyFallback := discordReplyRelation(messageManager, roomID, m.Message); relatesTo != nil {
+				content["m.relates_to"] = relatesTo
+				content["formatted_body"] = replyFallback + fmt.Sprint(content["formatted_body"])
+			}
+
+			err = limiter.Do(roomID, func() error {
+				var sendErr error
+				ev, sendErr = mg.SendMessageEvent(roomID, "m.room.message", content)
+				return sendErr
+			})
 			if err != nil {
 				fmt.Fprintln(os.Stderr, "error sending to `"+roomID+"` : ", err)
 			}
 		}
 
-		if len(m.Message.Attachments) == 1 && m.Message.Attachments[0].Size <= 64*1024 {
-			attachment := m.Attachments[0]
-			upload, err := mg.UploadLink(attachment.URL)
+		var oversized []*discordgo.MessageAttachment
+		for _, attachment := range m.Message.Attachments {
+			if uploadSizeLimit > 0 && int64(attachment.Size) > uploadSizeLimit {
+				oversized = append(oversized, attachment)
+				continue
+			}
+
+			reader, _, sniffedMime, err := getContent(&config, attachment.URL)
 			if err != nil {
-				fmt.Fprintln(os.Stderr, "error uploading attachment to `"+config.Bridge[m.ChannelID]+"` : ", err)
+				fmt.Fprintln(os.Stderr, "error downloading attachment `"+attachment.Filename+"`: ", err)
+				oversized = append(oversized, attachment)
+				continue
 			}
 
-			if strings.HasPrefix(attachment.ContentType, "image/") {
-				_, err = mg.SendMessageEvent(roomID, "m.room.message", map[string]interface{}{
-					"body":     m.Author.Username + " uploaded " + attachment.Filename,
-					"filename": attachment.Filename,
-					"msgtype":  "m.image",
-					"url":      upload.ContentURI,
-					"info": map[string]interface{}{
-						"mimetype": attachment.ContentType,
-						"size":     attachment.Size,
-					},
-				})
-				if err != nil {
-					fmt.Fprintln(os.Stderr, "error sending attachment to `"+config.Bridge[m.ChannelID]+"` : ", err)
-				}
-			} else {
-				_, err = mg.SendMessageEvent(roomID, "m.room.message", map[string]interface{}{
+			data, err := io.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "error reading attachment `"+attachment.Filename+"`: ", err)
+				oversized = append(oversized, attachment)
+				continue
+			}
+
+			mimeType := attachment.ContentType
+			if mimeType == "" || mimeType == "application/octet-stream" {
+				mimeType = sniffedMime
+			}
+
+			upload, err := mg.UploadToContentRepo(bytes.NewReader(data), mimeType, int64(len(data)))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "error uploading attachment to `"+roomID+"` : ", err)
+				continue
+			}
+
+			err = limiter.Do(roomID, func() error {
+				_, sendErr := mg.SendMessageEvent(roomID, "m.room.message", map[string]interface{}{
 					"body":     m.Author.Username + " uploaded " + attachment.Filename,
 					"filename": attachment.Filename,
-					"msgtype":  "m.file",
+					"msgtype":  msgtypeForMime(mimeType),
 					"url":      upload.ContentURI,
-					"info": map[string]interface{}{
-						"mimetype": attachment.ContentType,
-						"size":     attachment.Size,
-					},
+					"info":     buildMediaInfo(&config, mimeType, data),
 				})
-				if err != nil {
-					fmt.Fprintln(os.Stderr, "error sending attachment to `"+config.Bridge[m.ChannelID]+"` : ", err)
-				}
+				return sendErr
+			})
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "error sending attachment to `"+roomID+"` : ", err)
 			}
-		} else if len(m.Attachments) != 0 {
+		}
+
+		if len(oversized) != 0 {
 			contentPlain := m.Author.Username + " uploaded files"
 			contentHTML := "<b>" + m.Author.Username + "</b> uploaded files<table><tr><th>Link</th><th>MIME Type</th><th>Size</th></tr>"
-			for _, attachment := range m.Message.Attachments {
+			for _, attachment := range oversized {
 				contentHTML += fmt.Sprintf("<tr><td><a href=\"%s\">%s</a></td><td>%s</td><td>%s</td></tr>", attachment.URL, html.EscapeString(attachment.Filename), attachment.ContentType, fileSize(attachment.Size))
 				contentPlain += fmt.Sprintf("\n%s (%s): %s", attachment.Filename, fileSize(attachment.Size), attachment.URL)
 			}
 			contentHTML += "</table>"
 
-			_, err = mg.SendFormattedText(roomID, contentPlain, contentHTML)
+			err = limiter.Do(roomID, func() error {
+				_, sendErr := mg.SendFormattedText(roomID, contentPlain, contentHTML)
+				return sendErr
+			})
 			if err != nil {
 				fmt.Fprintln(os.Stderr, "error uploading file table", err)
 			}
@@ -356,22 +598,32 @@ func main() {
 
 		if ev != nil {
 			messageManager.Add(&MessageInfo{
-				DiscordID: m.ID,
+				DiscordID: m.ID, ChannelID: m.ChannelID,
 				WebhookID: "", WebhookToken: "",
 				MatrixID: ev.EventID, RoomID: config.Bridge[m.ChannelID],
+				Content: m.Content, Author: m.Author.Username,
 			})
 		}
 	})
 	dg.AddHandler(func(s *discordgo.Session, m *discordgo.MessageUpdate) {
 		messageInfo := messageManager.GetDiscord(m.ID)
-		if messageInfo != nil {
-			mg.SendMessageEvent(messageInfo.RoomID, "m.room.message", map[string]interface{}{
+		if messageInfo == nil {
+			return
+		}
+
+		newFormattedBody := discordMsgToMatrixHTML(m.Author.Username, m.Content)
+		if _, replyFallback := discordReplyRelation(messageManager, messageInfo.RoomID, m.Message); replyFallback != "" {
+			newFormattedBody = replyFallback + newFormattedBody
+		}
+
+		limiter.Do(messageInfo.RoomID, func() error {
+			_, sendErr := mg.SendMessageEvent(messageInfo.RoomID, "m.room.message", map[string]interface{}{
 				"body":    "* " + m.Author.Username + ": " + m.Content,
 				"msgtype": "m.text",
 				"m.new_content": map[string]interface{}{
 					"body":           m.Author.Username + ": " + m.Content,
 					"format":         "org.matrix.custom.html",
-					"formatted_body": discordMsgToMatrixHTML(m.Author.Username, m.Content),
+					"formatted_body": newFormattedBody,
 					"msgtype":        "m.text",
 				},
 				"m.relates_to": map[string]interface{}{
@@ -379,6 +631,17 @@ func main() {
 					"event_id": messageInfo.MatrixID,
 				},
 			})
+			return sendErr
+		})
+	})
+	dg.AddHandler(func(s *discordgo.Session, m *discordgo.MessageDelete) {
+		messageInfo := messageManager.GetDiscord(m.ID)
+		if messageInfo == nil {
+			return
+		}
+
+		if err := redactMatrixEvent(&config, messageInfo.RoomID, messageInfo.MatrixID); err != nil {
+			fmt.Fprintln(os.Stderr, "error redacting matrix event: ", err)
 		}
 	})
 
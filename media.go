@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// fetchMatrixUploadLimit queries the homeserver's configured maximum upload
+// size once at startup, so attachments above it can fall back to a link
+// table instead of failing the upload outright. Returns 0 if the homeserver
+// doesn't report a limit or can't be reached.
+func fetchMatrixUploadLimit(config *Config) int64 {
+	resp, err := http.Get(config.Matrix.Homeserver + "/_matrix/media/r0/config")
+	if err != nil {
+		return 0
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		UploadSize int64 `json:"m.upload.size"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0
+	}
+	return body.UploadSize
+}
+
+// msgtypeForMime picks the Matrix msgtype an attachment's MIME type should be
+// sent as.
+func msgtypeForMime(mimeType string) string {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return "m.image"
+	case strings.HasPrefix(mimeType, "video/"):
+		return "m.video"
+	case strings.HasPrefix(mimeType, "audio/"):
+		return "m.audio"
+	default:
+		return "m.file"
+	}
+}
+
+// buildMediaInfo fills in a Matrix "info" block for data, adding width/height
+// for images via image.DecodeConfig and, when config.ProbeMediaDuration is
+// set, width/height/duration for audio/video via an ffprobe shell-out.
+func buildMediaInfo(config *Config, mimeType string, data []byte) map[string]interface{} {
+	info := map[string]interface{}{
+		"mimetype": mimeType,
+		"size":     len(data),
+	}
+
+	if strings.HasPrefix(mimeType, "image/") {
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+			info["w"] = cfg.Width
+			info["h"] = cfg.Height
+		}
+		return info
+	}
+
+	isAV := strings.HasPrefix(mimeType, "video/") || strings.HasPrefix(mimeType, "audio/")
+	if isAV && config.ProbeMediaDuration {
+		if durationMs, width, height, err := probeMedia(data); err == nil {
+			info["duration"] = durationMs
+			if width > 0 && height > 0 {
+				info["w"] = width
+				info["h"] = height
+			}
+		}
+	}
+
+	return info
+}
+
+// probeMedia shells out to ffprobe to read a video/audio file's duration
+// (milliseconds) and, for video, its frame dimensions. ffprobe must be on
+// PATH; callers only reach this when config.ProbeMediaDuration is enabled.
+func probeMedia(data []byte) (float64, int, int, error) {
+	cmd := exec.Command("ffprobe", "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", "pipe:0")
+	cmd.Stdin = bytes.NewReader(data)
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	var probe struct {
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+		Streams []struct {
+			Width  int `json:"width"`
+			Height int `json:"height"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return 0, 0, 0, err
+	}
+
+	seconds, _ := strconv.ParseFloat(probe.Format.Duration, 64)
+	width, height := 0, 0
+	if len(probe.Streams) != 0 {
+		width, height = probe.Streams[0].Width, probe.Streams[0].Height
+	}
+	return seconds * 1000, width, height, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// NicknameCacheEntry caches a single Matrix user's display name and avatar.
+type NicknameCacheEntry struct {
+	DisplayName string
+	AvatarURL   string
+	lastUpdated time.Time
+}
+
+// NicknameCache resolves Matrix display names and avatars for bridged
+// webhook posts, refreshing lazily once an entry is older than ttl.
+type NicknameCache struct {
+	config *Config
+	ttl    time.Duration
+
+	entries map[string]*NicknameCacheEntry
+	lock    sync.RWMutex
+}
+
+func NewNicknameCache(config *Config, ttl time.Duration) *NicknameCache {
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	return &NicknameCache{config: config, ttl: ttl, entries: make(map[string]*NicknameCacheEntry)}
+}
+
+type matrixProfile struct {
+	DisplayName string `json:"displayname"`
+	AvatarURL   string `json:"avatar_url"`
+}
+
+func (c *NicknameCache) fetch(userID string) (*NicknameCacheEntry, error) {
+	req, err := http.NewRequest("GET", c.config.Matrix.Homeserver+"/_matrix/client/r0/profile/"+url.PathEscape(userID), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.config.Matrix.AccessToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var profile matrixProfile
+	if err := json.NewDecoder(resp.Body).Decode(&profile); err != nil {
+		return nil, err
+	}
+
+	displayName := profile.DisplayName
+	if displayName == "" {
+		displayName = stripMatrixName(userID)
+	}
+
+	return &NicknameCacheEntry{DisplayName: displayName, AvatarURL: profile.AvatarURL, lastUpdated: time.Now()}, nil
+}
+
+// Get returns the display name and avatar (mxc:// URL, possibly empty) for
+// userID, refreshing the cache from the homeserver if the entry is missing
+// or has expired.
+func (c *NicknameCache) Get(userID string) (string, string) {
+	c.lock.RLock()
+	entry, ok := c.entries[userID]
+	c.lock.RUnlock()
+
+	if ok && time.Since(entry.lastUpdated) < c.ttl {
+		return entry.DisplayName, entry.AvatarURL
+	}
+
+	fresh, err := c.fetch(userID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error fetching profile for "+userID+": ", err)
+		if ok {
+			return entry.DisplayName, entry.AvatarURL
+		}
+		return stripMatrixName(userID), ""
+	}
+
+	c.lock.Lock()
+	c.entries[userID] = fresh
+	c.lock.Unlock()
+
+	return fresh.DisplayName, fresh.AvatarURL
+}
+
+// Invalidate discards the cached profile for userID, so the next Get call
+// re-fetches it from the homeserver. Called on m.room.member events so
+// renames and avatar changes propagate promptly instead of waiting out ttl.
+func (c *NicknameCache) Invalidate(userID string) {
+	c.lock.Lock()
+	delete(c.entries, userID)
+	c.lock.Unlock()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// maxRateLimitRetries bounds how many times RateLimiter.Do will back off and
+// retry a single send before giving up and returning the last error.
+const maxRateLimitRetries = 5
+
+// RateLimiter serializes sends per Discord channel or Matrix room, so a burst
+// of edits/sends waits its turn instead of erroring out, and backs off for as
+// long as Discord or Matrix asks when a send is rate-limited.
+type RateLimiter struct {
+	locks map[string]*sync.Mutex
+	lock  sync.Mutex
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{locks: make(map[string]*sync.Mutex)}
+}
+
+func (r *RateLimiter) mutexFor(key string) *sync.Mutex {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	mu, ok := r.locks[key]
+	if !ok {
+		mu = &sync.Mutex{}
+		r.locks[key] = mu
+	}
+	return mu
+}
+
+// Do runs fn, serialized per key against every other call for the same key.
+// If fn's error indicates a Discord or Matrix rate limit, it sleeps for the
+// requested backoff and retries, up to maxRateLimitRetries times.
+func (r *RateLimiter) Do(key string, fn func() error) error {
+	mu := r.mutexFor(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		delay, limited := rateLimitDelay(err)
+		if !limited || attempt == maxRateLimitRetries {
+			return err
+		}
+		time.Sleep(delay)
+	}
+}
+
+var matrixRetryAfterMs = regexp.MustCompile(`"retry_after_ms"\s*:\s*(\d+)`)
+
+// rateLimitDelay inspects err for Discord's 429 X-RateLimit-Reset-After
+// header or Matrix's M_LIMIT_EXCEEDED retry_after_ms field, returning how
+// long to back off before retrying.
+func rateLimitDelay(err error) (time.Duration, bool) {
+	if err == nil {
+		return 0, false
+	}
+
+	if restErr, ok := err.(*discordgo.RESTError); ok && restErr.Response != nil && restErr.Response.StatusCode == http.StatusTooManyRequests {
+		if after := restErr.Response.Header.Get("X-RateLimit-Reset-After"); after != "" {
+			if seconds, parseErr := strconv.ParseFloat(after, 64); parseErr == nil {
+				return time.Duration(seconds * float64(time.Second)), true
+			}
+		}
+		return time.Second, true
+	}
+
+	// gomatrix doesn't expose a typed rate-limit error, but its HTTPError.Error()
+	// includes the homeserver's raw JSON body, so M_LIMIT_EXCEEDED and
+	// retry_after_ms can be recovered from the message text.
+	if strings.Contains(err.Error(), "M_LIMIT_EXCEEDED") {
+		if match := matrixRetryAfterMs.FindStringSubmatch(err.Error()); match != nil {
+			if ms, parseErr := strconv.Atoi(match[1]); parseErr == nil {
+				return time.Duration(ms) * time.Millisecond, true
+			}
+		}
+		return time.Second, true
+	}
+
+	return 0, false
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"strings"
 	"sync"
@@ -15,6 +18,13 @@ import (
 type WebhookInfo struct {
 	ID    string `json:"id"`
 	Token string `json:"token"`
+
+	// The Matrix avatar (mxc:// URL) the webhook's current Discord avatar was
+	// derived from, and the resulting Discord CDN URL. Kept together so a
+	// changed Matrix avatar can be detected without re-uploading on every
+	// message.
+	AvatarSource string `json:"avatar_source"`
+	AvatarURL    string `json:"avatar_url"`
 }
 
 type WebhookManager struct {
@@ -66,6 +76,56 @@ func (m *WebhookManager) Get(channel string, username string) (string, string, e
 	return webhook.ID, webhook.Token, nil
 }
 
+// SyncAvatar re-uploads avatarSource (a Matrix mxc:// avatar URL) to the
+// webhook for channel/username if it changed, and returns the Discord avatar
+// URL to use for the next message (empty if there's nothing to show or the
+// webhook is unknown).
+func (m *WebhookManager) SyncAvatar(config *Config, channel string, username string, avatarSource string) string {
+	key := channel + " | " + username
+	m.lock.RLock()
+	webhook, ok := m.webhooks[key]
+	m.lock.RUnlock()
+	if !ok {
+		return ""
+	}
+	if avatarSource == "" || webhook.AvatarSource == avatarSource {
+		return webhook.AvatarURL
+	}
+
+	reader, _, _, err := getContent(config, avatarSource)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error downloading avatar for "+username+": ", err)
+		return webhook.AvatarURL
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading avatar for "+username+": ", err)
+		return webhook.AvatarURL
+	}
+
+	mimeType := http.DetectContentType(data)
+	avatarData := "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(data)
+	updated, err := m.dg.WebhookEditWithToken(webhook.ID, webhook.Token, "", avatarData)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error updating webhook avatar for "+username+": ", err)
+		return webhook.AvatarURL
+	}
+
+	webhook.AvatarSource = avatarSource
+	webhook.AvatarURL = "https://cdn.discordapp.com/avatars/" + webhook.ID + "/" + updated.Avatar + ".png"
+
+	m.lock.Lock()
+	m.webhooks[key] = webhook
+	m.lock.Unlock()
+	if err := m.save(); err != nil {
+		fmt.Fprintf(os.Stderr, "error saving webhooks: "+err.Error())
+	}
+
+	return webhook.AvatarURL
+}
+
 func (m *WebhookManager) Has(id string) bool {
 	m.lock.RLock()
 	defer m.lock.RUnlock()